@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestUpsertBlobDeduplicates(t *testing.T) {
+	db = newTestDB(t)
+
+	first, err := upsertBlob(Blob{Hash: "h1", StoredName: "a.jpg", ThumbnailName: "a_thumb.jpg", MimeType: "image/jpeg", Size: 100, RefCount: 1})
+	if err != nil {
+		t.Fatalf("upsertBlob (first): %v", err)
+	}
+	if first.RefCount != 1 {
+		t.Fatalf("first.RefCount = %d, want 1", first.RefCount)
+	}
+
+	second, err := upsertBlob(Blob{Hash: "h1", StoredName: "b.jpg", ThumbnailName: "b_thumb.jpg", MimeType: "image/jpeg", Size: 200, RefCount: 1})
+	if err != nil {
+		t.Fatalf("upsertBlob (second): %v", err)
+	}
+	if second.RefCount != 2 {
+		t.Fatalf("second.RefCount = %d, want 2", second.RefCount)
+	}
+	if second.StoredName != first.StoredName {
+		t.Fatalf("second.StoredName = %q, want %q (first upload should win the race)", second.StoredName, first.StoredName)
+	}
+}
+
+func TestGetAndIncrementBlobNotFound(t *testing.T) {
+	db = newTestDB(t)
+
+	if _, err := getAndIncrementBlob("missing"); err != sql.ErrNoRows {
+		t.Fatalf("getAndIncrementBlob(missing) err = %v, want sql.ErrNoRows", err)
+	}
+}
+
+// TestGetAndIncrementBlobRacesDecrement regresses the dedup-hit-vs-release
+// race: a blob's last reference can be dropped (decrementBlobRefCount) at
+// the same moment a concurrent upload of identical content tries to attach
+// to it (getAndIncrementBlob). The increment must either observe the blob
+// intact, or miss cleanly with sql.ErrNoRows -- it must never report success
+// against a blob row the decrement has already deleted.
+func TestGetAndIncrementBlobRacesDecrement(t *testing.T) {
+	db = newTestDB(t)
+
+	for i := 0; i < 200; i++ {
+		hash := fmt.Sprintf("hash-%d", i)
+		if _, err := upsertBlob(Blob{Hash: hash, StoredName: "a.jpg", ThumbnailName: "a_thumb.jpg", MimeType: "image/jpeg", Size: 1, RefCount: 1}); err != nil {
+			t.Fatalf("upsertBlob: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		var incErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, incErr = getAndIncrementBlob(hash)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := decrementBlobRefCount(hash); err != nil {
+				t.Errorf("decrementBlobRefCount: %v", err)
+			}
+		}()
+		close(start)
+		wg.Wait()
+
+		if incErr != nil && incErr != sql.ErrNoRows {
+			t.Fatalf("getAndIncrementBlob returned unexpected error: %v", incErr)
+		}
+		if incErr == nil {
+			if _, err := getBlob(hash); err != nil {
+				t.Fatalf("blob %q vanished after a successful getAndIncrementBlob: %v", hash, err)
+			}
+		}
+	}
+}
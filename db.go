@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	METADATA_DB_PATH = "./guapi.db"
+	DEFAULT_FILE_TTL = 24 * time.Hour
+	JANITOR_INTERVAL = 10 * time.Minute
+)
+
+var db *sql.DB
+
+// Blob is a deduplicated, content-addressed stored image (original plus
+// thumbnail) shared by every FileRecord with a matching ContentHash.
+type Blob struct {
+	Hash          string
+	StoredName    string
+	ThumbnailName string
+	MimeType      string
+	Size          int64
+	RefCount      int
+}
+
+// FileRecord is one user-facing upload: a name and an uploader pointing at a
+// deduplicated Blob.
+type FileRecord struct {
+	ID           string
+	OriginalName string
+	ContentHash  string
+	UploaderIP   string
+	DeleteToken  string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+func initDB() {
+	opened, err := sql.Open("sqlite", METADATA_DB_PATH)
+	if err != nil {
+		log.Fatal("Could not open metadata database:", err)
+	}
+	if err := createSchema(opened); err != nil {
+		log.Fatal("Could not create schema:", err)
+	}
+	db = opened
+}
+
+// createSchema creates the blobs/files tables if they don't already exist.
+// Split out from initDB so tests can stand up a throwaway in-memory database
+// with the same schema.
+func createSchema(d *sql.DB) error {
+	_, err := d.Exec(`
+		CREATE TABLE IF NOT EXISTS blobs (
+			hash TEXT PRIMARY KEY,
+			stored_name TEXT NOT NULL,
+			thumbnail_name TEXT NOT NULL,
+			mime_type TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			ref_count INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("could not create blobs table: %w", err)
+	}
+
+	_, err = d.Exec(`
+		CREATE TABLE IF NOT EXISTS files (
+			id TEXT PRIMARY KEY,
+			original_name TEXT NOT NULL,
+			content_hash TEXT NOT NULL,
+			uploader_ip TEXT NOT NULL,
+			delete_token TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("could not create files table: %w", err)
+	}
+	return nil
+}
+
+func getBlob(hash string) (*Blob, error) {
+	var b Blob
+	err := db.QueryRow(
+		`SELECT hash, stored_name, thumbnail_name, mime_type, size, ref_count FROM blobs WHERE hash = ?`,
+		hash,
+	).Scan(&b.Hash, &b.StoredName, &b.ThumbnailName, &b.MimeType, &b.Size, &b.RefCount)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// upsertBlob inserts a freshly stored blob, or, if a concurrent upload of
+// the same content already landed one, bumps its ref count instead. It
+// returns the canonical row either way so the caller can tell whether its
+// own stored files won the race.
+func upsertBlob(b Blob) (*Blob, error) {
+	_, err := db.Exec(
+		`INSERT INTO blobs (hash, stored_name, thumbnail_name, mime_type, size, ref_count)
+		 VALUES (?, ?, ?, ?, ?, 1)
+		 ON CONFLICT(hash) DO UPDATE SET ref_count = ref_count + 1`,
+		b.Hash, b.StoredName, b.ThumbnailName, b.MimeType, b.Size,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return getBlob(b.Hash)
+}
+
+// getAndIncrementBlob atomically looks up a blob by hash and bumps its ref
+// count in the same transaction, so a concurrent release of the blob's last
+// reference can never land between the lookup and the increment. It returns
+// sql.ErrNoRows if the blob doesn't exist (or was deleted concurrently),
+// mirroring getBlob so callers can treat both cases identically.
+func getAndIncrementBlob(hash string) (*Blob, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var b Blob
+	err = tx.QueryRow(
+		`SELECT hash, stored_name, thumbnail_name, mime_type, size, ref_count FROM blobs WHERE hash = ?`,
+		hash,
+	).Scan(&b.Hash, &b.StoredName, &b.ThumbnailName, &b.MimeType, &b.Size, &b.RefCount)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(`UPDATE blobs SET ref_count = ref_count + 1 WHERE hash = ?`, hash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	b.RefCount++
+
+	return &b, tx.Commit()
+}
+
+// decrementBlobRefCount drops a blob's ref count and deletes its row once
+// the count reaches zero, reporting whether that happened so the caller
+// knows whether to remove the underlying stored files.
+func decrementBlobRefCount(hash string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = ?`, hash); err != nil {
+		return false, err
+	}
+
+	var refCount int
+	if err := tx.QueryRow(`SELECT ref_count FROM blobs WHERE hash = ?`, hash).Scan(&refCount); err != nil {
+		return false, err
+	}
+
+	if refCount <= 0 {
+		if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = ?`, hash); err != nil {
+			return false, err
+		}
+	}
+
+	return refCount <= 0, tx.Commit()
+}
+
+func insertFileRecord(rec FileRecord) error {
+	_, err := db.Exec(
+		`INSERT INTO files (id, original_name, content_hash, uploader_ip, delete_token, created_at, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rec.ID, rec.OriginalName, rec.ContentHash, rec.UploaderIP, rec.DeleteToken, rec.CreatedAt, rec.ExpiresAt,
+	)
+	return err
+}
+
+func getFileRecord(id string) (*FileRecord, error) {
+	var rec FileRecord
+	err := db.QueryRow(
+		`SELECT id, original_name, content_hash, uploader_ip, delete_token, created_at, expires_at
+		 FROM files WHERE id = ?`,
+		id,
+	).Scan(&rec.ID, &rec.OriginalName, &rec.ContentHash, &rec.UploaderIP, &rec.DeleteToken, &rec.CreatedAt, &rec.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func deleteFileRecord(id string) error {
+	_, err := db.Exec(`DELETE FROM files WHERE id = ?`, id)
+	return err
+}
+
+func expiredFileRecords(now time.Time) ([]FileRecord, error) {
+	rows, err := db.Query(
+		`SELECT id, original_name, content_hash, uploader_ip, delete_token, created_at, expires_at
+		 FROM files WHERE expires_at <= ?`,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []FileRecord
+	for rows.Next() {
+		var rec FileRecord
+		if err := rows.Scan(&rec.ID, &rec.OriginalName, &rec.ContentHash, &rec.UploaderIP, &rec.DeleteToken, &rec.CreatedAt, &rec.ExpiresAt); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// releaseFileRecord deletes a file's metadata record and, if it held the
+// last reference to its blob, the underlying stored files too.
+func releaseFileRecord(rec FileRecord) error {
+	blob, err := getBlob(rec.ContentHash)
+	if err != nil {
+		return err
+	}
+
+	lastRef, err := decrementBlobRefCount(rec.ContentHash)
+	if err != nil {
+		return err
+	}
+
+	if lastRef {
+		if err := storage.RemoveFile(blob.StoredName); err != nil {
+			return err
+		}
+		if err := storage.RemoveFile(blob.ThumbnailName); err != nil {
+			return err
+		}
+	}
+
+	return deleteFileRecord(rec.ID)
+}
+
+// startJanitor periodically removes files (and, once unreferenced, blobs)
+// past their expiry from both the database and the storage backend.
+func startJanitor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepExpiredFiles()
+		}
+	}()
+}
+
+func sweepExpiredFiles() {
+	records, err := expiredFileRecords(time.Now())
+	if err != nil {
+		log.Println("Janitor: could not query expired files:", err)
+		return
+	}
+
+	for _, rec := range records {
+		if err := releaseFileRecord(rec); err != nil {
+			log.Println("Janitor: could not release expired file", rec.ID, ":", err)
+		}
+	}
+}
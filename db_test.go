@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestDB stands up a throwaway in-memory database with the production
+// schema and points the package-level db at it for the duration of the test.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	d, err := sql.Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatalf("could not open test db: %v", err)
+	}
+	// A pooled :memory: database is per-connection; pin the pool to a single
+	// connection so every statement in the test sees the same schema/data.
+	d.SetMaxOpenConns(1)
+	if err := createSchema(d); err != nil {
+		t.Fatalf("could not create schema: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestFileRecordLifecycle(t *testing.T) {
+	db = newTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	rec := FileRecord{
+		ID:           "file-1",
+		OriginalName: "photo.jpg",
+		ContentHash:  "deadbeef",
+		UploaderIP:   "127.0.0.1",
+		DeleteToken:  "token-1",
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(time.Hour),
+	}
+	if err := insertFileRecord(rec); err != nil {
+		t.Fatalf("insertFileRecord: %v", err)
+	}
+
+	got, err := getFileRecord(rec.ID)
+	if err != nil {
+		t.Fatalf("getFileRecord: %v", err)
+	}
+	if got.OriginalName != rec.OriginalName || got.ContentHash != rec.ContentHash {
+		t.Fatalf("getFileRecord = %+v, want %+v", got, rec)
+	}
+
+	if err := deleteFileRecord(rec.ID); err != nil {
+		t.Fatalf("deleteFileRecord: %v", err)
+	}
+	if _, err := getFileRecord(rec.ID); err == nil {
+		t.Fatal("getFileRecord succeeded after deleteFileRecord, want an error")
+	}
+}
+
+func TestExpiredFileRecords(t *testing.T) {
+	db = newTestDB(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := FileRecord{
+		ID: "expired", OriginalName: "old.jpg", ContentHash: "h1",
+		UploaderIP: "127.0.0.1", DeleteToken: "t1",
+		CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour),
+	}
+	fresh := FileRecord{
+		ID: "fresh", OriginalName: "new.jpg", ContentHash: "h2",
+		UploaderIP: "127.0.0.1", DeleteToken: "t2",
+		CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+	}
+	if err := insertFileRecord(expired); err != nil {
+		t.Fatalf("insertFileRecord(expired): %v", err)
+	}
+	if err := insertFileRecord(fresh); err != nil {
+		t.Fatalf("insertFileRecord(fresh): %v", err)
+	}
+
+	records, err := expiredFileRecords(now)
+	if err != nil {
+		t.Fatalf("expiredFileRecords: %v", err)
+	}
+	if len(records) != 1 || records[0].ID != expired.ID {
+		t.Fatalf("expiredFileRecords = %+v, want only %q", records, expired.ID)
+	}
+}
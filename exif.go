@@ -0,0 +1,15 @@
+package main
+
+import (
+	exifremove "github.com/scottleedavis/go-exif-remove"
+)
+
+// stripExif removes EXIF metadata (GPS coordinates, camera make/model, etc.)
+// from JPEG bytes before they're decoded and re-encoded. PNGs carry no EXIF
+// segment and are returned unchanged.
+func stripExif(data []byte, mimeType string) ([]byte, error) {
+	if mimeType != "image/jpeg" {
+		return data, nil
+	}
+	return exifremove.Remove(data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// filesHandler serves GET /files/{id} and DELETE /files/{id}?token=...
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	if id == "" {
+		http.Error(w, "Missing file id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getFileHandler(w, r, id)
+	case http.MethodDelete:
+		deleteFileHandler(w, r, id)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+func getFileHandler(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := getFileRecord(id)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	blob, err := getBlob(rec.ContentHash)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	storedName := blob.StoredName
+	if r.URL.Query().Get("size") == "thumb" {
+		storedName = blob.ThumbnailName
+	}
+
+	reader, err := storage.GetFile(storedName)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", blob.MimeType)
+	io.Copy(w, reader)
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := getFileRecord(id)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" || token != rec.DeleteToken {
+		http.Error(w, "Invalid or missing delete token", http.StatusForbidden)
+		return
+	}
+
+	if err := releaseFileRecord(*rec); err != nil {
+		http.Error(w, "Could not delete file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
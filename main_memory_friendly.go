@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
@@ -8,7 +12,6 @@ import (
 	"image/png"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -18,7 +21,6 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/nfnt/resize"
-	"github.com/patrickmn/go-cache"
 )
 
 const (
@@ -27,16 +29,30 @@ const (
 	CONCURRENT_LIMIT = 10 // Limit concurrent image processing
 )
 
-var (
-	imgCache *cache.Cache
-	wg       sync.WaitGroup
-	sem      = make(chan struct{}, CONCURRENT_LIMIT) // Semaphore to limit concurrent goroutines
-)
+// sem bounds the number of images decoded/resized/encoded at once across all
+// requests; wg tracking in-flight work is per-request (see uploadFileHandler)
+// so one request's completion never waits on an unrelated request's uploads.
+var sem = make(chan struct{}, CONCURRENT_LIMIT)
 
 type UploadResult struct {
-	FileName string `json:"file_name"`
-	Status   string `json:"status"`
-	Error    string `json:"error,omitempty"`
+	FileName     string `json:"file_name"`
+	ID           string `json:"id,omitempty"`
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	DeleteToken  string `json:"delete_token,omitempty"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+}
+
+func extensionForMimeType(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	default:
+		return ""
+	}
 }
 
 func ensureUploadFolderExists() {
@@ -45,23 +61,62 @@ func ensureUploadFolderExists() {
 	}
 }
 
-func init() {
-	imgCache = cache.New(5*time.Minute, 10*time.Minute)
+// generateUniqueFileName derives a storage-safe name from originalName,
+// discarding any directory components so a caller-supplied name (from a
+// multipart filename or the raw upload endpoint) can never escape the
+// storage backend's base directory.
+func generateUniqueFileName(originalName string, ext string) string {
+	base := filepath.Base(filepath.Clean(originalName))
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	return fmt.Sprintf("%s_%s%s", name, uuid.New().String(), ext)
 }
 
-func generateUniqueFileName(originalName string) string {
-	ext := filepath.Ext(originalName)
-	name := strings.TrimSuffix(originalName, ext)
-	return fmt.Sprintf("%s_%s%s", name, uuid.New().String(), ext)
+// attachFileRecord creates a new FileRecord pointing at an existing blob
+// (freshly stored or deduplicated) and reports the result on ch.
+func attachFileRecord(originalName string, blob *Blob, uploaderIP string, ch chan<- UploadResult) {
+	now := time.Now()
+	rec := FileRecord{
+		ID:           uuid.New().String(),
+		OriginalName: originalName,
+		ContentHash:  blob.Hash,
+		UploaderIP:   uploaderIP,
+		DeleteToken:  uuid.New().String(),
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(DEFAULT_FILE_TTL),
+	}
+	if err := insertFileRecord(rec); err != nil {
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not save file metadata"}
+		return
+	}
+
+	ch <- UploadResult{
+		FileName:     blob.StoredName,
+		ID:           rec.ID,
+		URL:          "/files/" + rec.ID,
+		ThumbnailURL: "/files/" + rec.ID + "?size=thumb",
+		DeleteToken:  rec.DeleteToken,
+		Status:       "success",
+	}
 }
 
-func processAndSaveImage(handler *multipart.FileHeader, file io.Reader, ext string, ch chan<- UploadResult) {
-	defer wg.Done()
-	defer func() { <-sem }() // Release semaphore slot
+func processAndSaveImage(originalName string, data []byte, mimeType string, contentHash string, uploaderIP string, ch chan<- UploadResult) {
+	if blob, err := getAndIncrementBlob(contentHash); err == nil {
+		attachFileRecord(originalName, blob, uploaderIP, ch)
+		return
+	} else if err != sql.ErrNoRows {
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not reference existing file"}
+		return
+	}
 
-	img, _, err := image.Decode(file)
+	data, err := stripExif(data, mimeType)
 	if err != nil {
-		ch <- UploadResult{FileName: handler.Filename, Status: "failed", Error: "Error decoding image"}
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not strip image metadata"}
+		return
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Error decoding image"}
 		return
 	}
 
@@ -69,34 +124,62 @@ func processAndSaveImage(handler *multipart.FileHeader, file io.Reader, ext stri
 		img = resize.Resize(1920, 1080, img, resize.Lanczos3)
 	}
 
-	cacheKey := handler.Filename
-	if cachedImg, found := imgCache.Get(cacheKey); found {
-		img = cachedImg.(image.Image)
-	} else {
-		imgCache.Set(cacheKey, img, cache.DefaultExpiration)
-	}
+	ext := extensionForMimeType(mimeType)
+	uniqueFileName := generateUniqueFileName(originalName, ext)
+	thumbFileName := strings.TrimSuffix(uniqueFileName, ext) + "_thumb" + ext
 
-	uniqueFileName := generateUniqueFileName(handler.Filename)
-	filePath := filepath.Join(UPLOAD_FOLDER, uniqueFileName)
-	outFile, err := os.Create(filePath)
+	var buf, thumbBuf bytes.Buffer
+	thumb := resize.Thumbnail(256, 256, img, resize.Lanczos3)
+	switch mimeType {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+		if err == nil {
+			err = jpeg.Encode(&thumbBuf, thumb, nil)
+		}
+	case "image/png":
+		err = png.Encode(&buf, img)
+		if err == nil {
+			err = png.Encode(&thumbBuf, thumb)
+		}
+	}
 	if err != nil {
-		ch <- UploadResult{FileName: handler.Filename, Status: "failed", Error: "Could not create file"}
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not encode resized image"}
 		return
 	}
-	defer outFile.Close()
 
-	switch ext {
-	case ".jpg", ".jpeg":
-		err = jpeg.Encode(outFile, img, nil)
-	case ".png":
-		err = png.Encode(outFile, img)
+	size := int64(buf.Len())
+	if _, err := storage.AddFile(uniqueFileName, &buf); err != nil {
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not save resized image"}
+		return
+	}
+
+	if _, err := storage.AddFile(thumbFileName, &thumbBuf); err != nil {
+		storage.RemoveFile(uniqueFileName)
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not save thumbnail"}
+		return
 	}
+
+	winner, err := upsertBlob(Blob{
+		Hash:          contentHash,
+		StoredName:    uniqueFileName,
+		ThumbnailName: thumbFileName,
+		MimeType:      mimeType,
+		Size:          size,
+		RefCount:      1,
+	})
 	if err != nil {
-		ch <- UploadResult{FileName: handler.Filename, Status: "failed", Error: "Could not save resized image"}
+		storage.RemoveFile(uniqueFileName)
+		storage.RemoveFile(thumbFileName)
+		ch <- UploadResult{FileName: originalName, Status: "failed", Error: "Could not save file metadata"}
 		return
 	}
+	if winner.StoredName != uniqueFileName {
+		// Lost the race to an identical concurrent upload; drop our duplicate files.
+		storage.RemoveFile(uniqueFileName)
+		storage.RemoveFile(thumbFileName)
+	}
 
-	ch <- UploadResult{FileName: uniqueFileName, Status: "success"}
+	attachFileRecord(originalName, winner, uploaderIP, ch)
 }
 
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -105,50 +188,97 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, MAX_UPLOAD_SIZE)
-	err := r.ParseMultipartForm(MAX_UPLOAD_SIZE)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "File too large. File should be under 4 MB", http.StatusRequestEntityTooLarge)
+		http.Error(w, "Invalid multipart request", http.StatusBadRequest)
 		return
 	}
 
-	files := r.MultipartForm.File["files"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
-		return
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []UploadResult
+	)
+	addResult := func(result UploadResult) {
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
 	}
 
-	results := make([]UploadResult, 0, len(files))
-	ch := make(chan UploadResult, len(files))
+	ch := make(chan UploadResult)
+	done := make(chan struct{})
+	go func() {
+		for result := range ch {
+			addResult(result)
+		}
+		close(done)
+	}()
 
-	for _, handler := range files {
-		file, err := handler.Open()
+	sawFile := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			results = append(results, UploadResult{FileName: handler.Filename, Status: "failed", Error: "Could not open uploaded file"})
+			http.Error(w, "Error reading multipart body", http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() != "files" || part.FileName() == "" {
+			part.Close()
 			continue
 		}
+		sawFile = true
+
+		fileName := part.FileName()
 
-		if handler.Size > MAX_UPLOAD_SIZE {
-			results = append(results, UploadResult{FileName: handler.Filename, Status: "failed", Error: "File size exceeds 4 MB limit"})
+		var buf bytes.Buffer
+		hasher := sha256.New()
+		n, copyErr := io.Copy(io.MultiWriter(&buf, hasher), io.LimitReader(part, MAX_UPLOAD_SIZE+1))
+		if copyErr != nil {
+			part.Close()
+			addResult(UploadResult{FileName: fileName, Status: "failed", Error: "Could not read uploaded file"})
 			continue
 		}
+		if n > MAX_UPLOAD_SIZE {
+			// Don't call part.Close() here: it drains the rest of the part
+			// off the wire (io.Copy to io.Discard), which is exactly the
+			// unbounded read MAX_UPLOAD_SIZE is meant to prevent. Abort the
+			// whole request instead of reading further.
+			wg.Wait()
+			close(ch)
+			<-done
+			http.Error(w, "File size exceeds 4 MB limit", http.StatusRequestEntityTooLarge)
+			return
+		}
+		part.Close()
 
-		ext := strings.ToLower(filepath.Ext(handler.Filename))
-		if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
-			results = append(results, UploadResult{FileName: handler.Filename, Status: "failed", Error: "Only .jpg, .jpeg, and .png files are allowed"})
+		data := buf.Bytes()
+		mimeType := http.DetectContentType(data)
+		if extensionForMimeType(mimeType) == "" {
+			addResult(UploadResult{FileName: fileName, Status: "failed", Error: "Only .jpg, .jpeg, and .png files are allowed"})
 			continue
 		}
+		contentHash := hex.EncodeToString(hasher.Sum(nil))
 
 		wg.Add(1)
 		sem <- struct{}{} // Acquire semaphore slot
-		go processAndSaveImage(handler, file, ext, ch)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }() // Release semaphore slot
+			processAndSaveImage(fileName, data, mimeType, contentHash, r.RemoteAddr, ch)
+		}()
+	}
+
+	if !sawFile {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
 	}
 
 	wg.Wait()
 	close(ch)
-	for result := range ch {
-		results = append(results, result)
-	}
+	<-done
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(results)
@@ -156,8 +286,14 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	ensureUploadFolderExists()
+	initStorage()
+	initDB()
+	startJanitor(JANITOR_INTERVAL)
 
 	http.HandleFunc("/upload", uploadFileHandler)
+	http.HandleFunc("/upload/raw", rawUploadFileHandler)
+	http.HandleFunc("/files/", filesHandler)
+	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(UPLOAD_FOLDER))))
 
 	log.Println("Starting server on :8090...")
 	err := http.ListenAndServe(":8090", nil)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// rawUploadFileHandler accepts a single image as the raw request body (no
+// multipart envelope), taking the filename from X-Filename or ?name= and
+// sharing processAndSaveImage with the multipart endpoint.
+func rawUploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileName := r.Header.Get("X-Filename")
+	if fileName == "" {
+		fileName = r.URL.Query().Get("name")
+	}
+	if fileName == "" {
+		http.Error(w, "Missing filename: set X-Filename header or ?name=", http.StatusBadRequest)
+		return
+	}
+
+	var buf bytes.Buffer
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(&buf, hasher), io.LimitReader(r.Body, MAX_UPLOAD_SIZE+1))
+	if err != nil {
+		http.Error(w, "Could not read request body", http.StatusBadRequest)
+		return
+	}
+	if n > MAX_UPLOAD_SIZE {
+		http.Error(w, "File size exceeds 4 MB limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	data := buf.Bytes()
+	mimeType := http.DetectContentType(data)
+	if extensionForMimeType(mimeType) == "" {
+		http.Error(w, "Only .jpg, .jpeg, and .png files are allowed", http.StatusBadRequest)
+		return
+	}
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+
+	ch := make(chan UploadResult, 1)
+	sem <- struct{}{} // Acquire semaphore slot
+	func() {
+		defer func() { <-sem }() // Release semaphore slot
+		processAndSaveImage(fileName, data, mimeType, contentHash, r.RemoteAddr, ch)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(<-ch)
+}
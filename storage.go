@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Storage persists uploaded files to a backing store and serves them back out.
+type Storage interface {
+	AddFile(name string, r io.Reader) (url string, err error)
+	RemoveFile(name string) error
+	GetFile(name string) (io.ReadCloser, error)
+}
+
+var storage Storage
+
+// initStorage selects the Storage driver from STORAGE_DRIVER (local|s3|minio),
+// defaulting to local disk when unset.
+func initStorage() {
+	switch os.Getenv("STORAGE_DRIVER") {
+	case "s3", "minio":
+		s, err := newS3Storage()
+		if err != nil {
+			log.Fatal("Could not initialize s3 storage:", err)
+		}
+		storage = s
+	default:
+		storage = newLocalStorage(UPLOAD_FOLDER)
+	}
+}
+
+// LocalStorage persists files under a directory on disk, served via /uploads/.
+type LocalStorage struct {
+	baseDir string
+}
+
+func newLocalStorage(baseDir string) *LocalStorage {
+	return &LocalStorage{baseDir: baseDir}
+}
+
+func (l *LocalStorage) AddFile(name string, r io.Reader) (string, error) {
+	outFile, err := os.Create(filepath.Join(l.baseDir, name))
+	if err != nil {
+		return "", fmt.Errorf("could not create file: %w", err)
+	}
+	defer outFile.Close()
+
+	if _, err := io.Copy(outFile, r); err != nil {
+		return "", fmt.Errorf("could not write file: %w", err)
+	}
+
+	return "/uploads/" + name, nil
+}
+
+func (l *LocalStorage) RemoveFile(name string) error {
+	return os.Remove(filepath.Join(l.baseDir, name))
+}
+
+func (l *LocalStorage) GetFile(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.baseDir, name))
+}
+
+// S3Storage streams files to an S3-compatible bucket (AWS S3 or minio via
+// S3_ENDPOINT).
+type S3Storage struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3Storage() (*S3Storage, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET must be set when STORAGE_DRIVER=s3 or minio")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func (s *S3Storage) AddFile(name string, r io.Reader) (string, error) {
+	_, err := s.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   r,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not upload to s3: %w", err)
+	}
+
+	if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", endpoint, s.bucket, name), nil
+	}
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, name), nil
+}
+
+func (s *S3Storage) RemoveFile(name string) error {
+	_, err := s.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
+
+func (s *S3Storage) GetFile(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}